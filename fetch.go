@@ -0,0 +1,330 @@
+package xhr
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gopherjs/gopherjs/js"
+)
+
+// maxBufferedRequestBody is the largest request body FetchTransport will
+// buffer into memory up front. Bodies above this size, as well as
+// bodies of unknown length, are streamed to the server instead.
+const maxBufferedRequestBody = 1 << 20 // 1 MiB
+
+// FetchTransport is an implementation of http.RoundTripper that uses the
+// browser's Fetch API instead of XMLHttpRequest. Unlike Transport, the
+// response body returned by RoundTrip streams its data from the
+// underlying ReadableStream as it arrives, instead of buffering the
+// entire response into memory up front. This matters for large
+// downloads and for responses that are produced incrementally, such as
+// server-sent events. Request bodies of unknown or large size are
+// likewise streamed to the server via a ReadableStream rather than
+// buffered, see maxBufferedRequestBody.
+//
+// FetchTransport requires a browser that implements both the Fetch API
+// and ReadableStream. Use DefaultTransport to automatically fall back to
+// Transport when those are unavailable.
+type FetchTransport struct {
+	mu       sync.Mutex
+	inflight map[*http.Request]*js.Object // AbortController
+
+	// ProgressFunc, if set, is called for every download progress event
+	// of requests made through this FetchTransport. The Fetch API does
+	// not expose upload progress, so only download progress is
+	// reported.
+	ProgressFunc func(*http.Request, ProgressEvent)
+}
+
+// DefaultTransport is the default http.RoundTripper used by this
+// package. It uses FetchTransport when the browser supports the Fetch
+// API and ReadableStream, and falls back to Transport (XMLHttpRequest)
+// otherwise.
+var DefaultTransport http.RoundTripper = newDefaultTransport()
+
+func newDefaultTransport() http.RoundTripper {
+	if hasFetch() {
+		return &FetchTransport{}
+	}
+	return &Transport{}
+}
+
+func hasFetch() bool {
+	return js.Global.Get("fetch") != js.Undefined && js.Global.Get("ReadableStream") != js.Undefined
+}
+
+func (t *FetchTransport) setCanceler(req *http.Request, ac *js.Object) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.inflight == nil {
+		t.inflight = map[*http.Request]*js.Object{}
+	}
+	if ac == nil {
+		delete(t.inflight, req)
+		return
+	}
+	t.inflight[req] = ac
+}
+
+// CancelRequest cancels an in-flight request by calling abort on its
+// AbortController. It implements the optional interface used by
+// net/http.Client.
+func (t *FetchTransport) CancelRequest(req *http.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ac := t.inflight[req]; ac != nil {
+		ac.Call("abort")
+	}
+}
+
+func (t *FetchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Host != "" {
+		return nil, errors.New("cannot set Host header with fetch")
+	}
+
+	headers := js.Global.Get("Headers").New()
+	for k, v := range req.Header {
+		for _, vv := range v {
+			headers.Call("append", k, vv)
+		}
+	}
+
+	// ac, and the t.inflight entry pointing at it, must stay alive for as
+	// long as the response body may still be read, not just until
+	// headers arrive — that's the whole point of CancelRequest/context
+	// cancellation working on a streamed download. Ownership of clearing
+	// the entry passes to the returned fetchBody once one is handed back
+	// to the caller; see fetchBody.done.
+	ac := js.Global.Get("AbortController").New()
+	t.setCanceler(req, ac)
+	ownCanceler := true
+	defer func() {
+		if ownCanceler {
+			t.setCanceler(req, nil)
+		}
+	}()
+
+	opts := js.M{
+		"method":  req.Method,
+		"headers": headers,
+		"signal":  ac.Get("signal"),
+	}
+	if req.Body != nil {
+		defer req.Body.Close()
+		if req.ContentLength < 0 || req.ContentLength > maxBufferedRequestBody {
+			// The body is of unknown or large size: stream it to the
+			// server via a ReadableStream instead of buffering it in
+			// full. Fetch requires "duplex: half" to be set whenever
+			// the request body is a stream.
+			opts["body"] = newReadableStream(req.Body)
+			opts["duplex"] = "half"
+		} else {
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			uint8 := js.Global.Get("Uint8Array").New(len(body))
+			js.CopyBytesToJS(uint8, body)
+			opts["body"] = uint8
+		}
+	}
+
+	respCh := make(chan struct {
+		resp *js.Object
+		err  error
+	}, 1)
+	promise := js.Global.Call("fetch", req.URL.String(), opts)
+	promise.Call("then", func(resp *js.Object) {
+		go func() {
+			respCh <- struct {
+				resp *js.Object
+				err  error
+			}{resp: resp}
+		}()
+	})
+	promise.Call("catch", func(err *js.Object) {
+		go func() {
+			respCh <- struct {
+				resp *js.Object
+				err  error
+			}{err: errors.New(err.Get("message").String())}
+		}()
+	})
+
+	var result struct {
+		resp *js.Object
+		err  error
+	}
+	select {
+	case result = <-respCh:
+	case <-req.Context().Done():
+		ac.Call("abort")
+		return nil, &ctxAbortError{req.Context().Err()}
+	}
+	if result.err != nil {
+		return nil, result.err
+	}
+	resp := result.resp
+
+	header := http.Header{}
+	resp.Get("headers").Call("forEach", func(value, key *js.Object) {
+		header.Add(key.String(), value.String())
+	})
+
+	var total int64 = -1
+	if cl, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+		total = cl
+	}
+	var onProgress func(ProgressEvent)
+	if t.ProgressFunc != nil {
+		onProgress = func(e ProgressEvent) { t.ProgressFunc(req, e) }
+	}
+	body := newFetchBody(resp.Get("body").Call("getReader"), total, onProgress, req.Context(), func() {
+		t.setCanceler(req, nil)
+	})
+	ownCanceler = false
+	return &http.Response{
+		Status:        resp.Get("statusText").String(),
+		StatusCode:    resp.Get("status").Int(),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: total,
+		Request:       req,
+	}, nil
+}
+
+// newReadableStream wraps r in a JavaScript ReadableStream that pulls
+// chunks from r on demand, for use as a streamed fetch request body.
+func newReadableStream(r io.Reader) *js.Object {
+	buf := make([]byte, 64*1024)
+	return js.Global.Get("ReadableStream").New(js.M{
+		"pull": func(controller *js.Object) *js.Object {
+			return js.Global.Get("Promise").New(func(resolve, reject *js.Object) {
+				go func() {
+					n, err := r.Read(buf)
+					if n > 0 {
+						chunk := js.Global.Get("Uint8Array").New(n)
+						js.CopyBytesToJS(chunk, buf[:n])
+						controller.Call("enqueue", chunk)
+					}
+					switch err {
+					case nil:
+					case io.EOF:
+						controller.Call("close")
+					default:
+						controller.Call("error", err.Error())
+					}
+					resolve.Invoke(js.Undefined)
+				}()
+			})
+		},
+	})
+}
+
+// fetchBody adapts a ReadableStreamDefaultReader to the io.ReadCloser
+// interface expected by http.Response.Body. It also owns the lifetime of
+// the FetchTransport's canceler entry for the request: for as long as
+// the body may still be read, CancelRequest and context cancellation
+// must be able to reach the stream and abort it, so the entry is only
+// cleared once the body is exhausted, errors out, or is closed early.
+type fetchBody struct {
+	reader     *js.Object
+	buf        []byte
+	total      int64
+	loaded     int64
+	onProgress func(ProgressEvent)
+	ctx        context.Context
+	finish     func() // clears the owning Transport's canceler entry
+}
+
+func newFetchBody(reader *js.Object, total int64, onProgress func(ProgressEvent), ctx context.Context, finish func()) *fetchBody {
+	return &fetchBody{reader: reader, total: total, onProgress: onProgress, ctx: ctx, finish: finish}
+}
+
+func (b *fetchBody) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		chunk, done, err := b.readChunk()
+		if err != nil {
+			return 0, err
+		}
+		if done {
+			return 0, io.EOF
+		}
+		b.buf = chunk
+		b.loaded += int64(len(chunk))
+		if b.onProgress != nil {
+			b.onProgress(ProgressEvent{
+				LengthComputable: b.total >= 0,
+				Loaded:           b.loaded,
+				Total:            b.total,
+			})
+		}
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+func (b *fetchBody) readChunk() (chunk []byte, done bool, err error) {
+	type result struct {
+		chunk []byte
+		done  bool
+		err   error
+	}
+	ch := make(chan result, 1)
+	promise := b.reader.Call("read")
+	promise.Call("then", func(r *js.Object) {
+		go func() {
+			if r.Get("done").Bool() {
+				ch <- result{done: true}
+				return
+			}
+			value := r.Get("value")
+			data := make([]byte, value.Get("length").Int())
+			js.CopyBytesToGo(data, value)
+			ch <- result{chunk: data}
+		}()
+	})
+	promise.Call("catch", func(err *js.Object) {
+		go func() {
+			ch <- result{err: errors.New(err.Get("message").String())}
+		}()
+	})
+
+	select {
+	case res := <-ch:
+		if res.done || res.err != nil {
+			b.done()
+		}
+		return res.chunk, res.done, res.err
+	case <-b.ctx.Done():
+		b.reader.Call("cancel")
+		b.done()
+		return nil, false, &ctxAbortError{b.ctx.Err()}
+	}
+}
+
+// done clears the owning Transport's canceler entry. It is safe to call
+// more than once; only the first call has an effect.
+func (b *fetchBody) done() {
+	if b.finish != nil {
+		b.finish()
+		b.finish = nil
+	}
+}
+
+// Close releases the underlying stream reader without reading the
+// remainder of the response body.
+func (b *fetchBody) Close() error {
+	b.reader.Call("cancel")
+	b.done()
+	return nil
+}
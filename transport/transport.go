@@ -1,112 +1,72 @@
+// Package transport is kept for backwards compatibility with callers
+// that imported the Transport type from this package before it was
+// folded into package xhr itself. Transport delegates all of its
+// behavior to an xhr.Transport; see that package for documentation of
+// the fields below.
 package transport
 
 import (
-	"bufio"
-	"bytes"
-	"errors"
-	"fmt"
-	"io"
-	"io/ioutil"
 	"net/http"
-	"net/textproto"
-	"strings"
-	"sync"
+	"time"
 
 	"honnef.co/go/js/xhr"
-
-	"github.com/gopherjs/gopherjs/js"
 )
 
+// Transport behaves like xhr.Transport. Its fields are declared
+// directly, rather than promoted from an embedded xhr.Transport, so
+// that callers can set them in a struct literal
+// (e.g. &transport.Transport{ProgressFunc: fn}), which promoted fields
+// do not allow.
 type Transport struct {
-	mu       sync.Mutex
-	inflight map[*http.Request]*xhr.Request
-}
+	inner xhr.Transport
 
-func (t *Transport) setCanceler(req *http.Request, x *xhr.Request) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	if t.inflight == nil {
-		t.inflight = map[*http.Request]*xhr.Request{}
-	}
-	if x == nil {
-		delete(t.inflight, req)
-		return
-	}
-	t.inflight[req] = x
-}
-
-func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
-	if req.Host != "" {
-		return nil, errors.New("cannot set Host header with XHR")
-	}
+	// ProgressFunc, if set, is called for every upload and download
+	// progress event of requests made through this Transport.
+	ProgressFunc func(*http.Request, xhr.ProgressEvent)
 
-	x := xhr.NewRequest(req.Method, req.URL.String())
-	x.ResponseType = xhr.ArrayBuffer
+	// Retries is the number of additional attempts made after a failed
+	// request when RetryOn reports the attempt as retryable. The zero
+	// value disables retries.
+	Retries int
 
-	for k, v := range req.Header {
-		for _, vv := range v {
-			x.SetRequestHeader(k, vv)
-		}
-	}
+	// RetryOn decides whether an attempt that produced resp and err
+	// should be retried. resp is nil if the attempt failed outright.
+	// The default retries on network errors as well as 429 and 5xx
+	// responses.
+	RetryOn func(resp *http.Response, err error) bool
 
-	var data []byte
-	var err error
-	if req.Body != nil {
-		defer req.Body.Close()
-		data, err = ioutil.ReadAll(req.Body)
-		if err != nil {
-			return nil, err
-		}
-	}
+	// Backoff returns how long to wait before the given retry attempt,
+	// starting at 1. The default is exponential backoff with jitter.
+	Backoff func(attempt int) time.Duration
 
-	// FIXME(dominikh): If CancelRequest is called before we can call
-	// x.Send, the cancellation will have no effect
-	t.setCanceler(req, x)
-	err = x.Send(data)
-	t.setCanceler(req, nil)
-	if err != nil {
-		return nil, err
-	}
+	// OnRequest, if non-empty, is called in order for every attempt
+	// before it is sent, and may be used to inject headers such as
+	// authentication or tracing information.
+	OnRequest []func(*http.Request)
 
-	if x.Response == nil {
-		// the request got cancelled after it was done, and in that
-		// case JS clears the Response field. Treat it like a request
-		// that was aborted in time.
-		return nil, xhr.ErrAborted
-	}
-
-	r := strings.NewReader(x.ResponseHeaders())
-	headers, err := textproto.NewReader(bufio.NewReader(r)).ReadMIMEHeader()
-	if err != nil && err != io.EOF {
-		return nil, err
-	}
+	// OnResponse, if non-empty, is called in order for every attempt
+	// after it completes, and may be used to observe results centrally,
+	// e.g. for logging or metrics.
+	OnResponse []func(*http.Response, error)
+}
 
-	var proto string
-	var major, minor int
-	if len(headers["Version"]) > 0 {
-		proto = headers["Version"][0]
-		major, minor, _ = http.ParseHTTPVersion(proto)
-	}
+// sync copies t's fields onto the inner xhr.Transport that does the
+// actual work, so that changes made to t after construction (not just
+// via struct literal) take effect on the next call.
+func (t *Transport) sync() {
+	t.inner.ProgressFunc = t.ProgressFunc
+	t.inner.Retries = t.Retries
+	t.inner.RetryOn = t.RetryOn
+	t.inner.Backoff = t.Backoff
+	t.inner.OnRequest = t.OnRequest
+	t.inner.OnResponse = t.OnResponse
+}
 
-	b := js.Global.Get("Uint8Array").New(x.Response).Interface().([]byte)
-	return &http.Response{
-		Status:        fmt.Sprintf("%d %s", x.Status, x.StatusText),
-		StatusCode:    x.Status,
-		Proto:         proto,
-		ProtoMajor:    major,
-		ProtoMinor:    minor,
-		Header:        http.Header(headers),
-		Body:          ioutil.NopCloser(bytes.NewReader(b)),
-		ContentLength: int64(len(b)),
-		// FIXME(dominikh): Go docs say the request's body will be nil
-		Request: req,
-	}, nil
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.sync()
+	return t.inner.RoundTrip(req)
 }
 
 func (t *Transport) CancelRequest(req *http.Request) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	if x := t.inflight[req]; x != nil {
-		x.Abort()
-	}
+	t.inner.CancelRequest(req)
 }
@@ -39,20 +39,27 @@
 //		}
 //		defer resp.Body.Close()
 //		// do stuff with resp.Body
+//
+// On browsers that support the Fetch API and ReadableStream,
+// DefaultTransport uses FetchTransport instead, which streams the
+// response body as it arrives rather than buffering it in full.
 
 package xhr // import "honnef.co/go/js/xhr"
 
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/textproto"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gopherjs/gopherjs/js"
 	"honnef.co/go/js/util"
@@ -120,6 +127,43 @@ func (r *Request) Upload() *Upload {
 	return &Upload{o, util.EventTarget{Object: o}}
 }
 
+// ProgressEvent describes the progress of a download or upload, as
+// reported by the DOM's ProgressEvent.
+type ProgressEvent struct {
+	// LengthComputable reports whether Total is known.
+	LengthComputable bool
+	// Loaded is the number of bytes transferred so far.
+	Loaded int64
+	// Total is the total number of bytes to transfer. It is only
+	// meaningful when LengthComputable is true.
+	Total int64
+}
+
+func newProgressEvent(o *js.Object) ProgressEvent {
+	return ProgressEvent{
+		LengthComputable: o.Get("lengthComputable").Bool(),
+		Loaded:           o.Get("loaded").Int64(),
+		Total:            o.Get("total").Int64(),
+	}
+}
+
+// OnProgress registers fn to be called for every "progress" event fired
+// while the response body is being downloaded.
+func (r *Request) OnProgress(fn func(ProgressEvent)) {
+	r.AddEventListener("progress", false, func(o *js.Object) {
+		fn(newProgressEvent(o))
+	})
+}
+
+// OnUploadProgress registers fn to be called for every "progress" event
+// fired while the request body is being uploaded. It is a convenience
+// wrapper around r.Upload().AddEventListener.
+func (r *Request) OnUploadProgress(fn func(ProgressEvent)) {
+	r.Upload().AddEventListener("progress", false, func(o *js.Object) {
+		fn(newProgressEvent(o))
+	})
+}
+
 // ErrAborted is the error returned by Send when a request was
 // aborted.
 var ErrAborted = errors.New("request aborted")
@@ -188,6 +232,16 @@ func (r *Request) OverrideMimeType(mimetype string) {
 // codes 4xx and 5xx are not treated as errors. In order to check
 // status codes, use the Request's Status field.
 func (r *Request) Send(data interface{}) error {
+	return r.SendContext(context.Background(), data)
+}
+
+// SendContext behaves like Send, but additionally aborts the request
+// if ctx is cancelled before a response has been received, and then
+// returns an error that wraps ctx.Err() and matches ErrAborted under
+// errors.Is. The cancellation hook is registered before the underlying
+// "send" call is made, so there is no window in which cancelling ctx
+// could race with Send and be silently dropped.
+func (r *Request) SendContext(ctx context.Context, data interface{}) error {
 	if r.ch != nil {
 		panic("must not use a Request for multiple requests")
 	}
@@ -203,8 +257,41 @@ func (r *Request) Send(data interface{}) error {
 	})
 
 	r.Call("send", data)
-	val := <-r.ch
-	return val
+	select {
+	case err := <-r.ch:
+		return err
+	case <-ctx.Done():
+		r.Abort()
+		return &ctxAbortError{ctx.Err()}
+	}
+}
+
+// ctxAbortError wraps a context error returned by SendContext, while
+// still comparing equal to ErrAborted under errors.Is, for callers that
+// checked for ErrAborted before context support was added.
+type ctxAbortError struct {
+	err error
+}
+
+func (e *ctxAbortError) Error() string { return e.err.Error() }
+func (e *ctxAbortError) Unwrap() error { return e.err }
+func (e *ctxAbortError) Is(target error) bool { return target == ErrAborted }
+
+// SendReader behaves like Send, but reads its request body from body
+// instead of taking it as an in-memory value.
+//
+// Request is a wrapper around XMLHttpRequest, which has no way to
+// stream a request body, so body is always read into memory in full
+// before the request is sent, regardless of whether the browser
+// supports the Fetch API. SendReader never streams. For true streaming
+// uploads, use FetchTransport instead, whose request bodies are backed
+// by a ReadableStream.
+func (r *Request) SendReader(body io.Reader) error {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	return r.Send(data)
 }
 
 // SetRequestHeader sets a header of the request.
@@ -234,6 +321,61 @@ func Send(method, url string, data []byte) ([]byte, error) {
 type Transport struct {
 	mu       sync.Mutex
 	inflight map[*http.Request]*Request
+
+	// ProgressFunc, if set, is called for every upload and download
+	// progress event of requests made through this Transport.
+	ProgressFunc func(*http.Request, ProgressEvent)
+
+	// Retries is the number of additional attempts made after a failed
+	// request when RetryOn reports the attempt as retryable. The zero
+	// value disables retries.
+	Retries int
+
+	// RetryOn decides whether an attempt that produced resp and err
+	// should be retried. resp is nil if the attempt failed outright.
+	// The default retries on network errors as well as 429 and 5xx
+	// responses.
+	RetryOn func(resp *http.Response, err error) bool
+
+	// Backoff returns how long to wait before the given retry attempt,
+	// starting at 1. The default is exponential backoff with jitter.
+	Backoff func(attempt int) time.Duration
+
+	// OnRequest, if non-empty, is called in order for every attempt
+	// before it is sent, and may be used to inject headers such as
+	// authentication or tracing information.
+	OnRequest []func(*http.Request)
+
+	// OnResponse, if non-empty, is called in order for every attempt
+	// after it completes, and may be used to observe results centrally,
+	// e.g. for logging or metrics.
+	OnResponse []func(*http.Response, error)
+}
+
+func (t *Transport) retryOn() func(*http.Response, error) bool {
+	if t.RetryOn != nil {
+		return t.RetryOn
+	}
+	return defaultRetryOn
+}
+
+func defaultRetryOn(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+func (t *Transport) backoff() func(attempt int) time.Duration {
+	if t.Backoff != nil {
+		return t.Backoff
+	}
+	return defaultBackoff
+}
+
+func defaultBackoff(attempt int) time.Duration {
+	base := 100 * time.Millisecond << uint(attempt-1)
+	return base + time.Duration(rand.Int63n(int64(base)))
 }
 
 func (t *Transport) setCanceler(req *http.Request, x *Request) {
@@ -249,11 +391,55 @@ func (t *Transport) setCanceler(req *http.Request, x *Request) {
 	t.inflight[req] = x
 }
 
+// RoundTrip sends req, retrying up to t.Retries times when t.RetryOn
+// reports an attempt's outcome as retryable, waiting t.Backoff between
+// attempts. req.Body, if any, is read into memory once up front so that
+// it can be resent on every attempt.
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	if req.Host != "" {
 		return nil, errors.New("cannot set Host header with XHR")
 	}
 
+	// req.Body is buffered in full, rather than streamed, so that it can
+	// be resent unchanged on every retry attempt. Transports that need
+	// to stream large or unbounded request bodies should use
+	// FetchTransport instead.
+	var data []byte
+	if req.Body != nil {
+		defer req.Body.Close()
+		var err error
+		data, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	retryOn := t.retryOn()
+	backoff := t.backoff()
+
+	var resp *http.Response
+	var err error
+	for attempt := 0; ; attempt++ {
+		for _, fn := range t.OnRequest {
+			fn(req)
+		}
+		resp, err = t.send(req, data)
+		for _, fn := range t.OnResponse {
+			fn(resp, err)
+		}
+		if attempt >= t.Retries || !retryOn(resp, err) {
+			return resp, err
+		}
+		select {
+		case <-time.After(backoff(attempt + 1)):
+		case <-req.Context().Done():
+			return nil, &ctxAbortError{req.Context().Err()}
+		}
+	}
+}
+
+// send performs a single XHR request/response attempt.
+func (t *Transport) send(req *http.Request, data []byte) (*http.Response, error) {
 	x := NewRequest(req.Method, req.URL.String())
 	x.ResponseType = ArrayBuffer
 
@@ -263,20 +449,13 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		}
 	}
 
-	var data []byte
-	var err error
-	if req.Body != nil {
-		defer req.Body.Close()
-		data, err = ioutil.ReadAll(req.Body)
-		if err != nil {
-			return nil, err
-		}
+	if t.ProgressFunc != nil {
+		x.OnProgress(func(e ProgressEvent) { t.ProgressFunc(req, e) })
+		x.OnUploadProgress(func(e ProgressEvent) { t.ProgressFunc(req, e) })
 	}
 
-	// FIXME(dominikh): If CancelRequest is called before we can call
-	// x.Send, the cancellation will have no effect
 	t.setCanceler(req, x)
-	err = x.Send(data)
+	err := x.SendContext(req.Context(), data)
 	t.setCanceler(req, nil)
 	if err != nil {
 		return nil, err